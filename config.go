@@ -0,0 +1,242 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileTarget is a single target as read from a -config file. Zero
+// values for Interval, Count and Timeout, and a nil Priv, mean "use the
+// -i/-n/-b/-priv default", not zero; see resolveTargets. Zero Size, TOS
+// and TTL have no command line default: a zero Size sends the minimal
+// 8 byte payload, and a zero TOS or TTL leaves the socket's value as is.
+type fileTarget struct {
+	Addr     string            `yaml:"addr" json:"addr"`
+	Interval duration          `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Count    int               `yaml:"count,omitempty" json:"count,omitempty"`
+	Timeout  duration          `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Source   string            `yaml:"source,omitempty" json:"source,omitempty"`
+	Size     int               `yaml:"size,omitempty" json:"size,omitempty"`
+	TOS      int               `yaml:"tos,omitempty" json:"tos,omitempty"`
+	TTL      int               `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+	Priv     *bool             `yaml:"priv,omitempty" json:"priv,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// fileConfig is the top level document read from a -config file.
+type fileConfig struct {
+	Targets []fileTarget `yaml:"targets" json:"targets"`
+}
+
+// duration is a time.Duration that unmarshals from the string forms
+// accepted by time.ParseDuration (e.g. "1s", "500ms"), for use in YAML
+// and JSON config files where a bare integer would otherwise be read
+// as nanoseconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads and parses a -config file. The format is chosen by
+// the file extension: ".json" is parsed as JSON, anything else as YAML
+// (which also accepts plain JSON documents).
+func loadConfig(path string) (*fileConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config %s: %w", path, err)
+	}
+	var cfg fileConfig
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(b, &cfg)
+	} else {
+		err = yaml.Unmarshal(b, &cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// target is a fully resolved ping target, combining either a -config
+// entry or a -a address with the -i/-n/-b/-priv command line defaults.
+type target struct {
+	addr     string
+	priv     bool
+	interval time.Duration
+	count    int
+	timeout  time.Duration
+	source   net.IP
+	size     int
+	tos      int
+	ttl      int
+	labels   map[string]string
+}
+
+// defaults holds the command line flag values used to fill in fields
+// that a target does not set for itself.
+type defaults struct {
+	priv     bool
+	interval time.Duration
+	count    int
+	timeout  time.Duration
+}
+
+// resolveTargets builds the list of targets to run from a parsed
+// -config file, falling back to the -a address set when cfg is nil.
+func resolveTargets(cfg *fileConfig, addrs set, def defaults) ([]target, error) {
+	if cfg == nil {
+		targets := make([]target, 0, len(addrs))
+		for addr, override := range addrs {
+			t := target{
+				addr:     addr,
+				priv:     def.priv,
+				interval: def.interval,
+				count:    def.count,
+				timeout:  def.timeout,
+			}
+			if override != nil {
+				t.priv = *override
+			}
+			targets = append(targets, t)
+		}
+		return targets, nil
+	}
+
+	targets := make([]target, len(cfg.Targets))
+	for i, ft := range cfg.Targets {
+		t := target{
+			addr:     ft.Addr,
+			priv:     def.priv,
+			interval: def.interval,
+			count:    def.count,
+			timeout:  def.timeout,
+			size:     ft.Size,
+			tos:      ft.TOS,
+			ttl:      ft.TTL,
+			labels:   ft.Labels,
+		}
+		if ft.Interval > 0 {
+			t.interval = time.Duration(ft.Interval)
+		}
+		if ft.Count > 0 {
+			t.count = ft.Count
+		}
+		if ft.Timeout > 0 {
+			t.timeout = time.Duration(ft.Timeout)
+		}
+		if ft.Priv != nil {
+			t.priv = *ft.Priv
+		}
+		if ft.Source != "" {
+			src, err := resolveSource(ft.Source)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: %w", ft.Addr, err)
+			}
+			t.source = src
+		}
+		targets[i] = t
+	}
+	return targets, nil
+}
+
+// resolveSource interprets s as either a literal source IP address or
+// the name of a local interface, returning the IPv4 address to ping
+// from.
+func resolveSource(s string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("resolve source %q: %w", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("resolve source %q: %w", s, err)
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, fmt.Errorf("resolve source %q: no IPv4 address on interface", s)
+}
+
+// run pings t in a loop, logging and, if m is non-nil, recording
+// metrics for each batch.
+func (t target) run(ctx context.Context, log *slog.Logger, probers *proberSet, m *metrics) {
+	labels := labelsValue(t.labels)
+	for {
+		start, stats, err := ping(probers, t)
+		attrs := []slog.Attr{
+			slog.String("addr", t.addr),
+			slog.Time("start", start),
+		}
+		if len(t.labels) != 0 {
+			attrs = append(attrs, slog.Any("labels", t.labels))
+		}
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "ping", append(attrs, slog.Any("error", err))...)
+			if m != nil {
+				m.observeError(t.addr, labels, err)
+			}
+			// A failing target (bad address, permanently
+			// unreachable prober, ...) must not spin a tight
+			// retry loop; pace retries at the same cadence a
+			// successful batch would have taken.
+			time.Sleep(t.timeout)
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "ping", append(attrs,
+			slog.Int("sent", stats.PacketsSent),
+			slog.Float64("loss", stats.PacketLoss),
+			slog.Duration("min_rtt", stats.MinRtt),
+			slog.Duration("max_rtt", stats.MaxRtt),
+			slog.Duration("avg_rtt", stats.AvgRtt),
+			slog.Duration("stdev_rtt", stats.StdDevRtt),
+		)...)
+		if m != nil {
+			m.observe(t.addr, labels, stats)
+		}
+	}
+}
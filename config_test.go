@@ -0,0 +1,101 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestDurationUnmarshalYAML(t *testing.T) {
+	var d duration
+	if err := yaml.Unmarshal([]byte(`"1500ms"`), &d); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if time.Duration(d) != 1500*time.Millisecond {
+		t.Errorf("d = %v, want %v", time.Duration(d), 1500*time.Millisecond)
+	}
+}
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	var d duration
+	if err := json.Unmarshal([]byte(`"1500ms"`), &d); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if time.Duration(d) != 1500*time.Millisecond {
+		t.Errorf("d = %v, want %v", time.Duration(d), 1500*time.Millisecond)
+	}
+}
+
+func TestResolveTargetsFromAddrs(t *testing.T) {
+	addrs := make(set)
+	if err := addrs.Set("example.com,other.example[!priv]"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	def := defaults{priv: true, interval: time.Second, count: 5, timeout: time.Minute}
+	targets, err := resolveTargets(nil, addrs, def)
+	if err != nil {
+		t.Fatalf("resolveTargets: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("len(targets) = %d, want 2", len(targets))
+	}
+	for _, tg := range targets {
+		if tg.interval != def.interval || tg.count != def.count || tg.timeout != def.timeout {
+			t.Errorf("target %s did not inherit defaults: %+v", tg.addr, tg)
+		}
+		switch tg.addr {
+		case "example.com":
+			if !tg.priv {
+				t.Errorf("target %s: priv = false, want true (inherited default)", tg.addr)
+			}
+		case "other.example":
+			if tg.priv {
+				t.Errorf("target %s: priv = true, want false (explicit override)", tg.addr)
+			}
+		default:
+			t.Errorf("unexpected target %s", tg.addr)
+		}
+	}
+}
+
+func TestResolveTargetsFromConfigOverridesDefaults(t *testing.T) {
+	def := defaults{priv: true, interval: time.Second, count: 5, timeout: time.Minute}
+	cfg := &fileConfig{
+		Targets: []fileTarget{
+			{Addr: "default.example"},
+			{Addr: "custom.example", Interval: duration(2 * time.Second), Count: 10, Priv: boolPtr(false)},
+		},
+	}
+	targets, err := resolveTargets(cfg, nil, def)
+	if err != nil {
+		t.Fatalf("resolveTargets: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("len(targets) = %d, want 2", len(targets))
+	}
+
+	got := targets[0]
+	if got.interval != def.interval || got.count != def.count || !got.priv {
+		t.Errorf("default.example did not inherit defaults: %+v", got)
+	}
+
+	got = targets[1]
+	if got.interval != 2*time.Second {
+		t.Errorf("custom.example interval = %v, want %v", got.interval, 2*time.Second)
+	}
+	if got.count != 10 {
+		t.Errorf("custom.example count = %d, want 10", got.count)
+	}
+	if got.priv {
+		t.Errorf("custom.example priv = true, want false (explicit override)")
+	}
+	if got.timeout != def.timeout {
+		t.Errorf("custom.example timeout = %v, want inherited default %v", got.timeout, def.timeout)
+	}
+}
@@ -13,88 +13,148 @@ import (
 	"os"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	probing "github.com/prometheus-community/pro-bing"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
 	addrs := make(set)
-	flag.Var(addrs, "a", "set of addresses to ping (comma separated)")
-	interval := flag.Duration("i", 10*time.Second, "interval between pings for each address")
-	batch := flag.Duration("b", time.Minute, "length of time for each batch of pings")
-	priv := flag.Bool("priv", true, "has access to raw network (requires setcap cap_net_raw=+ep or equivalent)")
-	n := flag.Int("n", 5, "number of ICMP packets for each batch of pings")
+	flag.Var(addrs, "a", "set of addresses to ping (comma separated); "+
+		"annotate a target with [priv] or [!priv], or prefix it with icmp:// or udp://, "+
+		"to override -priv for that target (udp:// requires net.ipv4.ping_group_range "+
+		"to include the ding process's group); ignored if -config is set")
+	interval := flag.Duration("i", 10*time.Second, "default interval between pings for each address")
+	batch := flag.Duration("b", time.Minute, "default length of time for each batch of pings")
+	priv := flag.Bool("priv", true, "default privileged (raw ICMP) mode for targets that don't override it (requires setcap cap_net_raw=+ep or equivalent)")
+	n := flag.Int("n", 5, "default number of ICMP packets for each batch of pings")
+	metricsAddr := flag.String("metrics", "", "if set, serve Prometheus metrics at this address (e.g. :9090)")
+	configPath := flag.String("config", "", "path to a YAML or JSON file listing targets with per-target "+
+		"interval, count, timeout, source, size, tos, ttl and labels; -i/-n/-b/-priv become defaults "+
+		"for fields a target does not set; labels are emitted as a slog attribute and joined into a "+
+		"single \"labels\" metric label on every Prometheus series")
 	flag.Parse()
 
 	log := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	ctx := context.Background()
 
-	var wg sync.WaitGroup
-	for {
-		for addr := range addrs {
-			addr := addr
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
+	var m *metrics
+	if *metricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		m = newMetrics(reg)
+		go serveMetrics(ctx, log, *metricsAddr, reg)
+	}
 
-				start, stats, err := ping(addr, *n, *interval, *batch, *priv)
-				if err != nil {
-					log.LogAttrs(ctx, slog.LevelError, "ping",
-						slog.String("addr", addr),
-						slog.Time("start", start),
-						slog.Any("error", err),
-					)
-					return
-				}
-				log.LogAttrs(ctx, slog.LevelInfo, "ping",
-					slog.String("addr", addr),
-					slog.Time("start", start),
-					slog.Int("sent", stats.PacketsSent),
-					slog.Float64("loss", stats.PacketLoss),
-					slog.Duration("min_rtt", stats.MinRtt),
-					slog.Duration("max_rtt", stats.MaxRtt),
-					slog.Duration("avg_rtt", stats.AvgRtt),
-					slog.Duration("stdev_rtt", stats.StdDevRtt),
-				)
-			}()
+	var cfg *fileConfig
+	if *configPath != "" {
+		var err error
+		cfg, err = loadConfig(*configPath)
+		if err != nil {
+			log.LogAttrs(ctx, slog.LevelError, "config", slog.Any("error", err))
+			os.Exit(1)
 		}
-		wg.Wait()
 	}
+	targets, err := resolveTargets(cfg, addrs, defaults{
+		priv:     *priv,
+		interval: *interval,
+		count:    *n,
+		timeout:  *batch,
+	})
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "config", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	probers := &proberSet{}
+	for _, t := range targets {
+		go t.run(ctx, log, probers, m)
+	}
+	select {}
 }
 
-func ping(addr string, n int, interval, timeout time.Duration, priv bool) (time.Time, *probing.Statistics, error) {
-	start := time.Now()
-	p, err := probing.NewPinger(addr)
+// ping submits a batch of echoes for t to the shared prober for its
+// privilege mode, allocating that prober on first use.
+func ping(probers *proberSet, t target) (time.Time, *probing.Statistics, error) {
+	p, err := probers.get(t.priv)
 	if err != nil {
-		return start, nil, err
+		return time.Now(), nil, err
 	}
-	p.SetPrivileged(priv)
-	p.Count = n
-	p.Interval = interval
-	p.Timeout = timeout
-	err = p.Run()
-	return start, p.Statistics(), err
+	return p.probe(t.addr, t.count, t.interval, t.timeout, probeOptions{
+		Source: t.source,
+		Size:   t.size,
+		TOS:    t.tos,
+		TTL:    t.ttl,
+	})
 }
 
-type set map[string]bool
+// set is the collection of ping targets given to -a. The value for
+// each target address is nil if the target uses the -priv default, or
+// a pointer to the per-target privileged mode override otherwise.
+type set map[string]*bool
 
+// Set implements flag.Value, accumulating a comma separated list of
+// targets. Each target may be annotated with a [priv] or [!priv]
+// suffix, or an icmp:// or udp:// scheme prefix, to override the
+// default -priv mode for that target alone.
 func (s set) Set(v string) error {
 	for _, y := range strings.Split(v, ",") {
-		if y == "" {
-			return errors.New("empty string target")
+		addr, priv, err := parseTarget(y)
+		if err != nil {
+			return err
 		}
-		s[y] = true
+		s[addr] = priv
 	}
 	return nil
 }
 
 func (s set) String() string {
 	p := make([]string, 0, len(s))
-	for y := range s {
-		p = append(p, y)
+	for y, priv := range s {
+		p = append(p, encodeTarget(y, priv))
 	}
 	sort.Strings(p)
 	return strings.Join(p, ",")
 }
+
+// parseTarget splits a -a target annotation into its bare address and
+// an optional privileged mode override.
+//
+// Recognised forms are:
+//
+//	addr           use the -priv default
+//	addr[priv]     force privileged (raw ICMP) mode
+//	addr[!priv]    force unprivileged (UDP ICMP) mode
+//	icmp://addr    equivalent to addr[priv]
+//	udp://addr     equivalent to addr[!priv]
+func parseTarget(v string) (addr string, priv *bool, err error) {
+	switch {
+	case v == "":
+		return "", nil, errors.New("empty string target")
+	case strings.HasPrefix(v, "icmp://"):
+		return strings.TrimPrefix(v, "icmp://"), boolPtr(true), nil
+	case strings.HasPrefix(v, "udp://"):
+		return strings.TrimPrefix(v, "udp://"), boolPtr(false), nil
+	case strings.HasSuffix(v, "[priv]"):
+		return strings.TrimSuffix(v, "[priv]"), boolPtr(true), nil
+	case strings.HasSuffix(v, "[!priv]"):
+		return strings.TrimSuffix(v, "[!priv]"), boolPtr(false), nil
+	default:
+		return v, nil, nil
+	}
+}
+
+// encodeTarget renders addr and its privileged mode override, if any,
+// back into the [!priv]-annotated form accepted by parseTarget.
+func encodeTarget(addr string, priv *bool) string {
+	switch {
+	case priv == nil:
+		return addr
+	case *priv:
+		return addr + "[priv]"
+	default:
+		return addr + "[!priv]"
+	}
+}
+
+func boolPtr(v bool) *bool { return &v }
@@ -0,0 +1,71 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestParseTarget(t *testing.T) {
+	cases := []struct {
+		in       string
+		wantAddr string
+		wantPriv *bool
+		wantErr  bool
+	}{
+		{in: "", wantErr: true},
+		{in: "example.com", wantAddr: "example.com"},
+		{in: "example.com[priv]", wantAddr: "example.com", wantPriv: boolPtr(true)},
+		{in: "example.com[!priv]", wantAddr: "example.com", wantPriv: boolPtr(false)},
+		{in: "icmp://example.com", wantAddr: "example.com", wantPriv: boolPtr(true)},
+		{in: "udp://example.com", wantAddr: "example.com", wantPriv: boolPtr(false)},
+	}
+	for _, c := range cases {
+		addr, priv, err := parseTarget(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseTarget(%q): want error, got nil", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTarget(%q): unexpected error: %v", c.in, err)
+			continue
+		}
+		if addr != c.wantAddr {
+			t.Errorf("parseTarget(%q): addr = %q, want %q", c.in, addr, c.wantAddr)
+		}
+		if (priv == nil) != (c.wantPriv == nil) || (priv != nil && *priv != *c.wantPriv) {
+			t.Errorf("parseTarget(%q): priv = %v, want %v", c.in, priv, c.wantPriv)
+		}
+	}
+}
+
+func TestEncodeTargetRoundTrip(t *testing.T) {
+	cases := []string{
+		"example.com",
+		"example.com[priv]",
+		"example.com[!priv]",
+	}
+	for _, in := range cases {
+		addr, priv, err := parseTarget(in)
+		if err != nil {
+			t.Fatalf("parseTarget(%q): %v", in, err)
+		}
+		got := encodeTarget(addr, priv)
+		if got != in {
+			t.Errorf("encodeTarget(parseTarget(%q)) = %q, want %q", in, got, in)
+		}
+	}
+}
+
+func TestSetString(t *testing.T) {
+	s := make(set)
+	if err := s.Set("b.example,a.example[priv],c.example[!priv]"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	want := "a.example[priv],b.example,c.example[!priv]"
+	if got := s.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
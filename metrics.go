@@ -0,0 +1,164 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+// metrics holds the Prometheus collectors updated at the end of each
+// ping batch, labelled by target address and, where a -config target
+// sets them, its labels.
+type metrics struct {
+	rtt         *prometheus.HistogramVec
+	rttMin      *prometheus.GaugeVec
+	rttMax      *prometheus.GaugeVec
+	rttStdDev   *prometheus.GaugeVec
+	packetsSent *prometheus.CounterVec
+	packetsRecv *prometheus.CounterVec
+	packetLoss  *prometheus.GaugeVec
+	batchErrors *prometheus.CounterVec
+}
+
+// newMetrics creates and registers the ding metric collectors with reg.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		rtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ding_rtt_seconds",
+			Help:    "Round trip time of each ICMP echo.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"addr", "labels"}),
+		rttMin: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ding_rtt_min_seconds",
+			Help: "Minimum round trip time of the most recent batch.",
+		}, []string{"addr", "labels"}),
+		rttMax: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ding_rtt_max_seconds",
+			Help: "Maximum round trip time of the most recent batch.",
+		}, []string{"addr", "labels"}),
+		rttStdDev: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ding_rtt_stddev_seconds",
+			Help: "Standard deviation of round trip time over the most recent batch.",
+		}, []string{"addr", "labels"}),
+		packetsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ding_packets_sent_total",
+			Help: "Total number of ICMP echo requests sent.",
+		}, []string{"addr", "labels"}),
+		packetsRecv: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ding_packets_received_total",
+			Help: "Total number of ICMP echo replies received.",
+		}, []string{"addr", "labels"}),
+		packetLoss: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ding_packet_loss_ratio",
+			Help: "Packet loss ratio of the most recent batch, in [0,1].",
+		}, []string{"addr", "labels"}),
+		batchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ding_batch_errors_total",
+			Help: "Total number of batches that failed to complete.",
+		}, []string{"addr", "error", "labels"}),
+	}
+	reg.MustRegister(m.rtt, m.rttMin, m.rttMax, m.rttStdDev, m.packetsSent, m.packetsRecv, m.packetLoss, m.batchErrors)
+	return m
+}
+
+// observe records the statistics of a completed batch for addr,
+// observing every sample in stats.Rtts into the histogram and setting
+// the batch's min/max/stddev gauges. labels is the rendered form of a
+// target's -config labels, as returned by labelsValue.
+func (m *metrics) observe(addr, labels string, stats *probing.Statistics) {
+	if stats.PacketsSent > 0 {
+		m.packetsSent.WithLabelValues(addr, labels).Add(float64(stats.PacketsSent))
+	}
+	if stats.PacketsRecv > 0 {
+		m.packetsRecv.WithLabelValues(addr, labels).Add(float64(stats.PacketsRecv))
+	}
+	m.packetLoss.WithLabelValues(addr, labels).Set(stats.PacketLoss / 100)
+	rttVec := m.rtt.WithLabelValues(addr, labels)
+	for _, rtt := range stats.Rtts {
+		rttVec.Observe(rtt.Seconds())
+	}
+	if len(stats.Rtts) > 0 {
+		m.rttMin.WithLabelValues(addr, labels).Set(stats.MinRtt.Seconds())
+		m.rttMax.WithLabelValues(addr, labels).Set(stats.MaxRtt.Seconds())
+		m.rttStdDev.WithLabelValues(addr, labels).Set(stats.StdDevRtt.Seconds())
+	}
+}
+
+// observeError records that a batch for addr failed with err. The
+// error label is a short, bounded-cardinality classification of err
+// rather than err.Error(), which would embed addresses and other
+// high-cardinality detail. labels is as for observe.
+func (m *metrics) observeError(addr, labels string, err error) {
+	m.batchErrors.WithLabelValues(addr, errKind(err), labels).Inc()
+}
+
+// labelsValue renders a target's -config labels into a single
+// Prometheus label value, since a label set's key names must be fixed
+// in advance but a -config file can declare arbitrary per-target keys.
+// The result is a sorted, comma separated list of "key=value" pairs,
+// or the empty string if labels is empty.
+func labelsValue(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + labels[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+// errKind classifies err into a short, bounded set of label values
+// suitable for use on a Prometheus counter.
+func errKind(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, os.ErrPermission):
+		return "permission"
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "resolve"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op
+	}
+	return "other"
+}
+
+// serveMetrics starts an HTTP server exposing the Prometheus registry
+// in the Prometheus text exposition format on addr at /metrics;
+// OpenMetrics negotiation is not enabled. It logs and returns
+// if the server cannot be started; callers should run it in its own
+// goroutine.
+func serveMetrics(ctx context.Context, log *slog.Logger, addr string, reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	log.LogAttrs(ctx, slog.LevelInfo, "metrics server listening", slog.String("addr", addr))
+	err := srv.ListenAndServe()
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelError, "metrics server", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestLabelsValue(t *testing.T) {
+	cases := []struct {
+		labels map[string]string
+		want   string
+	}{
+		{labels: nil, want: ""},
+		{labels: map[string]string{}, want: ""},
+		{labels: map[string]string{"env": "prod"}, want: "env=prod"},
+		{
+			labels: map[string]string{"env": "prod", "region": "us-east"},
+			want:   "env=prod,region=us-east",
+		},
+		{
+			// Keys must sort regardless of insertion order, so the
+			// same label set always renders to the same value.
+			labels: map[string]string{"region": "us-east", "env": "prod"},
+			want:   "env=prod,region=us-east",
+		},
+	}
+	for _, c := range cases {
+		if got := labelsValue(c.labels); got != c.want {
+			t.Errorf("labelsValue(%v) = %q, want %q", c.labels, got, c.want)
+		}
+	}
+}
+
+func TestErrKind(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{err: context.DeadlineExceeded, want: "timeout"},
+		{err: os.ErrPermission, want: "permission"},
+		{err: &net.DNSError{Err: "no such host", Name: "example.invalid"}, want: "resolve"},
+		{err: &net.OpError{Op: "write", Err: errors.New("boom")}, want: "write"},
+		{err: errors.New("something else"), want: "other"},
+	}
+	for _, c := range cases {
+		if got := errKind(c.err); got != c.want {
+			t.Errorf("errKind(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+// protoICMP is the IANA protocol number for ICMP, used when parsing
+// inbound messages regardless of whether they arrived over a raw or
+// ping (UDP) socket.
+const protoICMP = 1
+
+// prober is a shared ICMP echo listener that multiplexes requests and
+// replies for many concurrent targets over a single socket, instead of
+// opening one socket per target. In-flight echoes are distinguished by
+// sequence number, allocated uniquely across all submissions sharing
+// the prober; the echo ID is left constant for the listener's lifetime,
+// since Linux's unprivileged "ping socket" silently rewrites the ID to
+// the socket's bound port and so cannot be relied on for routing.
+type prober struct {
+	conn    *icmp.PacketConn
+	ipv4    *ipv4.PacketConn // per-packet TTL and source address control
+	network string           // "ip4:icmp" (raw) or "udp4" (unprivileged ping socket)
+	id      int
+
+	nextSeq uint32
+
+	mu      sync.Mutex
+	pending map[uint16]chan<- reply
+}
+
+// probeOptions carries the per-target settings that vary a batch of
+// echoes from the prober's defaults.
+type probeOptions struct {
+	// Source, if set, is the source address echoes are sent from.
+	Source net.IP
+	// Size is the number of payload bytes per echo; it is padded out
+	// to fit the 8 byte send timestamp if smaller.
+	Size int
+	// TOS, if non-zero, is the IPv4 type-of-service value to send
+	// with. It is set on the shared connection rather than per
+	// packet, so it is approximate when targets sharing a prober
+	// request different values.
+	TOS int
+	// TTL, if non-zero, is the IPv4 time-to-live to send with.
+	TTL int
+}
+
+// reply is a single ICMP echo reply observed by a prober's read loop.
+type reply struct {
+	rtt time.Duration
+}
+
+// newProber opens a shared ICMP listener on network, which must be
+// "ip4:icmp" for a privileged raw socket or "udp4" for an unprivileged
+// ping socket (see icmp(7) and the net.ipv4.ping_group_range sysctl,
+// which must include the process's group for the udp4 path to work).
+func newProber(network string) (*prober, error) {
+	conn, err := icmp.ListenPacket(network, "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("open %s icmp listener: %w", network, err)
+	}
+	p := &prober{
+		conn:    conn,
+		ipv4:    conn.IPv4PacketConn(),
+		network: network,
+		id:      os.Getpid() & 0xffff,
+		pending: make(map[uint16]chan<- reply),
+	}
+	go p.serve()
+	return p, nil
+}
+
+// serve reads incoming ICMP packets and routes echo replies to the
+// submission they answer for as long as the prober's listener is open.
+// It returns when the listener is closed.
+func (p *prober) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		recv := time.Now()
+		msg, err := icmp.ParseMessage(protoICMP, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || len(echo.Data) < 8 {
+			continue
+		}
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(echo.Data)))
+
+		p.mu.Lock()
+		ch, ok := p.pending[uint16(echo.Seq)]
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case ch <- reply{rtt: recv.Sub(sent)}:
+		default:
+		}
+	}
+}
+
+// submit allocates a sequence number from the shared pool and returns a
+// channel that receives its reply, if one arrives. release must be
+// called once the caller is done waiting, to free the sequence number.
+func (p *prober) submit() (seq uint16, replies <-chan reply, release func()) {
+	seq = uint16(atomic.AddUint32(&p.nextSeq, 1))
+	ch := make(chan reply, 1)
+	p.mu.Lock()
+	p.pending[seq] = ch
+	p.mu.Unlock()
+	return seq, ch, func() {
+		p.mu.Lock()
+		delete(p.pending, seq)
+		p.mu.Unlock()
+	}
+}
+
+// send writes a single ICMP echo request for seq to dst, stamping the
+// payload with the send time so the matching reply's RTT can be
+// measured without keeping any other per-packet state in the prober.
+func (p *prober) send(dst net.IP, seq uint16, opts probeOptions) error {
+	size := opts.Size
+	if size < 8 {
+		size = 8
+	}
+	data := make([]byte, size)
+	binary.BigEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+	wm := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   p.id,
+			Seq:  int(seq),
+			Data: data,
+		},
+	}
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	if p.ipv4 != nil {
+		if opts.TOS != 0 {
+			if err := p.ipv4.SetTOS(opts.TOS); err != nil {
+				return err
+			}
+		}
+		// ControlMessage.TTL is receiving-only; Marshal never encodes
+		// it into outbound ancillary data, so TTL must be set as a
+		// socket option instead, the same as TOS above.
+		if opts.TTL != 0 {
+			if err := p.ipv4.SetTTL(opts.TTL); err != nil {
+				return err
+			}
+		}
+	}
+
+	var addr net.Addr = &net.IPAddr{IP: dst}
+	if p.network == "udp4" {
+		addr = &net.UDPAddr{IP: dst}
+	}
+
+	if p.ipv4 != nil && opts.Source != nil {
+		cm := &ipv4.ControlMessage{Src: opts.Source}
+		_, err = p.ipv4.WriteTo(wb, cm, addr)
+		return err
+	}
+	_, err = p.conn.WriteTo(wb, addr)
+	return err
+}
+
+// close shuts down the prober's shared listener.
+func (p *prober) close() error {
+	return p.conn.Close()
+}
+
+// probe runs a batch of up to count echoes to addr spaced by interval,
+// bounding the entire send-and-wait cycle by timeout just as
+// probing.Pinger.Timeout bounded the whole of Run, and returns the
+// batch's start time and statistics in the same shape Run produced.
+func (p *prober) probe(addr string, count int, interval, timeout time.Duration, opts probeOptions) (time.Time, *probing.Statistics, error) {
+	start := time.Now()
+	dst, err := net.ResolveIPAddr("ip4", addr)
+	if err != nil {
+		return start, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type outstanding struct {
+		replies <-chan reply
+		release func()
+	}
+	waiting := make([]outstanding, 0, count)
+	defer func() {
+		for _, o := range waiting {
+			o.release()
+		}
+	}()
+
+sendLoop:
+	for i := 0; i < count; i++ {
+		seq, replies, release := p.submit()
+		waiting = append(waiting, outstanding{replies, release})
+		if err := p.send(dst.IP, seq, opts); err != nil {
+			return start, nil, err
+		}
+		if i < count-1 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				break sendLoop
+			}
+		}
+	}
+
+	replies := make([]<-chan reply, len(waiting))
+	for i, o := range waiting {
+		replies[i] = o.replies
+	}
+	rtts := collectReplies(ctx, replies)
+
+	stats := &probing.Statistics{PacketsSent: len(waiting), PacketsRecv: len(rtts), Rtts: rtts}
+	if len(waiting) > 0 {
+		stats.PacketLoss = float64(len(waiting)-len(rtts)) / float64(len(waiting)) * 100
+	}
+	if len(rtts) > 0 {
+		stats.MinRtt, stats.MaxRtt, stats.AvgRtt, stats.StdDevRtt = rttSummary(rtts)
+	}
+	return start, stats, nil
+}
+
+// collectReplies waits, up to ctx's deadline, for a reply on each of
+// replies in turn, and returns the RTT of every one that arrived.
+//
+// Each channel is checked non-blocking before falling back to a select
+// against ctx.Done(): once ctx is done, a bare
+// "select { case r := <-ch: ...; case <-ctx.Done(): ... }" has two
+// ready cases whenever ch already holds a value, and Go chooses
+// between ready cases at random, so a reply that arrived for an
+// earlier, slower packet could be dropped even though it's sitting in
+// the channel. Checking non-blocking first makes an already-arrived
+// reply always win, and only races against the deadline for a
+// sequence number that hasn't replied yet.
+func collectReplies(ctx context.Context, replies []<-chan reply) []time.Duration {
+	rtts := make([]time.Duration, 0, len(replies))
+	for _, ch := range replies {
+		select {
+		case r := <-ch:
+			rtts = append(rtts, r.rtt)
+			continue
+		default:
+		}
+		select {
+		case r := <-ch:
+			rtts = append(rtts, r.rtt)
+		case <-ctx.Done():
+		}
+	}
+	return rtts
+}
+
+// rttSummary computes the min, max, mean and standard deviation of
+// rtts, which must be non-empty.
+func rttSummary(rtts []time.Duration) (min, max, avg, stddev time.Duration) {
+	min, max = rtts[0], rtts[0]
+	var sum time.Duration
+	for _, r := range rtts {
+		if r < min {
+			min = r
+		}
+		if r > max {
+			max = r
+		}
+		sum += r
+	}
+	avg = sum / time.Duration(len(rtts))
+	var sumSq float64
+	for _, r := range rtts {
+		d := float64(r - avg)
+		sumSq += d * d
+	}
+	stddev = time.Duration(math.Sqrt(sumSq / float64(len(rtts))))
+	return min, max, avg, stddev
+}
+
+// proberSet lazily creates and shares one IPv4 prober per privilege
+// mode, so that all targets using the same mode multiplex their echoes
+// over a single socket. There is no IPv6 prober.
+type proberSet struct {
+	mu  sync.Mutex
+	raw *prober
+	udp *prober
+}
+
+// get returns the shared prober for priv, creating it on first use. If
+// a privileged raw listener cannot be opened, it falls back to the
+// shared unprivileged ping socket used by non-privileged targets.
+func (ps *proberSet) get(priv bool) (*prober, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if priv {
+		if ps.raw != nil {
+			return ps.raw, nil
+		}
+		if p, err := newProber("ip4:icmp"); err == nil {
+			ps.raw = p
+			return p, nil
+		}
+		// Raw sockets unavailable, for example because
+		// CAP_NET_RAW is not set; fall back to the shared
+		// unprivileged ping socket used by udp:// targets.
+	}
+	if ps.udp != nil {
+		return ps.udp, nil
+	}
+	p, err := newProber("udp4")
+	if err != nil {
+		return nil, err
+	}
+	ps.udp = p
+	return p, nil
+}
@@ -0,0 +1,70 @@
+// Copyright ©2023 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRttSummary(t *testing.T) {
+	rtts := []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		30 * time.Millisecond,
+	}
+	min, max, avg, stddev := rttSummary(rtts)
+	if min != 10*time.Millisecond {
+		t.Errorf("min = %v, want %v", min, 10*time.Millisecond)
+	}
+	if max != 30*time.Millisecond {
+		t.Errorf("max = %v, want %v", max, 30*time.Millisecond)
+	}
+	if avg != 20*time.Millisecond {
+		t.Errorf("avg = %v, want %v", avg, 20*time.Millisecond)
+	}
+	// Population standard deviation of {10,20,30}ms is sqrt(200/3)≈8.16ms.
+	wantStdDev := 8163 * time.Microsecond
+	if diff := stddev - wantStdDev; diff < -100*time.Microsecond || diff > 100*time.Microsecond {
+		t.Errorf("stddev = %v, want ~%v", stddev, wantStdDev)
+	}
+}
+
+// TestCollectRepliesKeepsBufferedReplyAfterDeadline guards against a
+// regression where an already-buffered reply for a later sequence
+// number was randomly dropped by a bare select against an already-done
+// context, just because an earlier sequence number in the batch had
+// no reply at all. Run many times since the bug this guards against
+// was probabilistic.
+func TestCollectRepliesKeepsBufferedReplyAfterDeadline(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		lost := make(chan reply, 1) // never sent to: simulates a lost packet
+		arrived := make(chan reply, 1)
+		arrived <- reply{rtt: time.Millisecond}
+
+		// The deadline has already passed by the time collectReplies
+		// looks at either channel, as it would if an earlier,
+		// slower packet blocked until the batch timeout expired.
+		cancel()
+
+		got := collectReplies(ctx, []<-chan reply{lost, arrived})
+		if len(got) != 1 {
+			t.Fatalf("run %d: collectReplies returned %d rtts, want 1 (buffered reply must not be dropped)", i, len(got))
+		}
+	}
+}
+
+func TestRttSummarySingle(t *testing.T) {
+	min, max, avg, stddev := rttSummary([]time.Duration{5 * time.Millisecond})
+	if min != 5*time.Millisecond || max != 5*time.Millisecond || avg != 5*time.Millisecond {
+		t.Errorf("min/max/avg = %v/%v/%v, want all %v", min, max, avg, 5*time.Millisecond)
+	}
+	if stddev != 0 {
+		t.Errorf("stddev = %v, want 0", stddev)
+	}
+}